@@ -29,13 +29,16 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"math/big"
 	"bytes"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/cockroachdb/pebble"
 )
@@ -71,6 +74,7 @@ type Collection struct {
  */ 
 type VectorDB struct {
 	db *pebble.DB
+	queryShards atomic.Int64 // number of key sub-ranges Query scans in parallel, 0 means runtime.NumCPU()
 }
 
 /*
@@ -182,6 +186,16 @@ func NewVectorDB(dbPath string) (*VectorDB, error) {
 	}, nil
 }
 
+/*
+ * This function sets the number of sub-ranges a collection is split into
+ * and scanned in parallel by Query. Values below 1 fall back to runtime.NumCPU().
+ * This is an upper limit: a collection with too few documents to split evenly gets
+ * fewer sub-ranges. It is safe to call while queries are running
+ */
+func (db *VectorDB) SetQueryShards(shards int) {
+	db.queryShards.Store(int64(shards))
+}
+
 /*
  * This function creates a new Collection
  */ 
@@ -309,35 +323,204 @@ func (db *VectorDB) Query(collectionName string, queryText string, metadataFilte
 		return matchingDoc, err
 	}
 
+	return db.queryByVector(collectionName, queryVec, metadataFilter)
+}
+
+/*
+ * This function finds the document nearest to the query vector, scanning the
+ * collection in parallel sub-ranges over a single snapshot of the DB. If a
+ * sub-range fails, the nearest document from the others is returned with the error
+ */
+func (db *VectorDB) queryByVector(collectionName string, queryVec []float64, metadataFilter map[string]interface{}) (Document, error) {
+	var matchingDoc Document
+
 	// Define the prefix for the keys in the collection.
 	prefix := []byte(collectionName + ":")
 
-	// Initialize variables to keep track of the nearest document.
-	//var nearestID string
-	maxSimilarity := -1.0
-
 	// Define the key range for the iterator based on the collection name.
 	lowerBound := prefix
 	upperBound := append(prefix, '\xff')
 
-	// Create an iterator with the specified key range.
-	iter := db.db.NewIter(&pebble.IterOptions{
-		LowerBound: lowerBound,
-		UpperBound: upperBound,
-	})
-
 	// Convert metadata filter keys to lowercase.
 	for key, value := range metadataFilter {
 		delete(metadataFilter, key)
 		metadataFilter[strings.ToLower(key)] = value
 	}
 
+	// Use one worker per CPU unless a shard count has been configured.
+	shards := int(db.queryShards.Load())
+	if shards < 1 {
+		shards = runtime.NumCPU()
+	}
+
+	// Pin one view of the data, so every worker sees the same documents.
+	snap := db.db.NewSnapshot()
+
+	// Split the collection's key range into sub-ranges of roughly equal size.
+	bounds, err := db.splitKeyRange(snap, lowerBound, upperBound, shards)
+	if err != nil {
+		snap.Close()
+		return matchingDoc, err
+	}
+
+	// Scan each sub-range concurrently, keeping a local best per worker.
+	results := make([]shardResult, len(bounds)-1)
+	var wg sync.WaitGroup
+	for i := 0; i < len(bounds)-1; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = scanShard(snap, bounds[i], bounds[i+1], queryVec, metadataFilter)
+		}(i)
+	}
+	wg.Wait()
+
+	firstErr := snap.Close()
+
+	// Merge the local results in key order, so ties resolve exactly as a single scan would.
+	maxSimilarity := -1.0
+	for _, result := range results {
+		if result.err != nil && firstErr == nil {
+			firstErr = result.err
+		}
+		if result.similarity > maxSimilarity {
+			maxSimilarity = result.similarity
+			matchingDoc = result.doc
+		}
+	}
+
+	// Return the ID of the nearest document.
+	return matchingDoc, firstErr
+}
+
+/*
+ * shardResult holds the nearest document found in one sub-range of a collection
+ */
+type shardResult struct {
+	doc        Document
+	similarity float64
+	err        error
+}
+
+/*
+ * This function splits the key range [lowerBound, upperBound) of the snapshot into at
+ * most shards sub-ranges holding roughly the same amount of data. Each cut is found by
+ * bisecting the keys between the first and last documents with EstimateDiskUsage, so
+ * no documents are read. Data still in the memtable is not counted; if the collection is
+ * only in the memtable, the key space between its first and last documents is split evenly.
+ * It returns the boundaries, starting with lowerBound and ending with upperBound
+ */
+func (db *VectorDB) splitKeyRange(snap *pebble.Snapshot, lowerBound, upperBound []byte, shards int) ([][]byte, error) {
+	bounds := [][]byte{lowerBound}
+	if shards <= 1 {
+		return append(bounds, upperBound), nil
+	}
+
+	// Find the first and last documents in the range. These are two seeks, not a scan.
+	iter := snap.NewIter(&pebble.IterOptions{
+		LowerBound: lowerBound,
+		UpperBound: upperBound,
+	})
+	var firstKey, lastKey []byte
+	if iter.First() {
+		firstKey = append([]byte(nil), iter.Key()...)
+	}
+	if iter.Last() {
+		lastKey = append([]byte(nil), iter.Key()...)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	if firstKey == nil || bytes.Compare(firstKey, lastKey) >= 0 {
+		return append(bounds, upperBound), nil
+	}
+
+	totalSize, err := db.db.EstimateDiskUsage(firstKey, lastKey)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 1; i < shards; i++ {
+		var cut []byte
+		if totalSize == 0 {
+			// Nothing is on disk yet, so split the key space evenly instead.
+			cut = interpolateKey(firstKey, lastKey, i, shards)
+		} else {
+			// Narrow [lo, hi] down to the key where the data before it reaches i/shards of the total.
+			lo, hi := firstKey, lastKey
+			for step := 0; step < 32; step++ {
+				mid := interpolateKey(lo, hi, 1, 2)
+				if bytes.Compare(mid, lo) <= 0 || bytes.Compare(mid, hi) >= 0 {
+					break
+				}
+				size, err := db.db.EstimateDiskUsage(firstKey, mid)
+				if err != nil {
+					return nil, err
+				}
+				if size*uint64(shards) < totalSize*uint64(i) {
+					lo = mid
+				} else {
+					hi = mid
+				}
+			}
+			cut = hi
+		}
+
+		// Skip cuts that would leave a sub-range empty.
+		if bytes.Compare(cut, bounds[len(bounds)-1]) > 0 && bytes.Compare(cut, firstKey) > 0 && bytes.Compare(cut, lastKey) <= 0 {
+			bounds = append(bounds, cut)
+		}
+	}
+
+	return append(bounds, upperBound), nil
+}
+
+/*
+ * This function returns the key num/den of the way from a to b, reading the eight
+ * bytes after their common prefix as a big-endian number
+ */
+func interpolateKey(a, b []byte, num, den int) []byte {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+
+	var x, y [8]byte
+	copy(x[:], a[n:])
+	copy(y[:], b[n:])
+	lo := new(big.Int).SetBytes(x[:])
+	step := new(big.Int).Sub(new(big.Int).SetBytes(y[:]), lo)
+	step.Mul(step, big.NewInt(int64(num)))
+	step.Div(step, big.NewInt(int64(den)))
+	lo.Add(lo, step)
+
+	key := append([]byte(nil), a[:n]...)
+	return append(key, lo.FillBytes(make([]byte, 8))...)
+}
+
+/*
+ * This function scans the key range [lowerBound, upperBound) of the snapshot and returns
+ * the document matching the metadata filter that is most similar to the query vector
+ */
+func scanShard(snap *pebble.Snapshot, lowerBound, upperBound []byte, queryVec []float64, metadataFilter map[string]interface{}) shardResult {
+	var matchingDoc Document
+
+	// Initialize variables to keep track of the nearest document.
+	maxSimilarity := -1.0
+
+	// Create an iterator with the specified key range.
+	iter := snap.NewIter(&pebble.IterOptions{
+		LowerBound: lowerBound,
+		UpperBound: upperBound,
+	})
+	defer iter.Close()
+
 	for iter.First(); iter.Valid(); iter.Next() {
 		// Deserialize the document.
 		var doc Document
 		err := json.Unmarshal(iter.Value(), &doc)
 		if err != nil {
-			return matchingDoc, err
+			return shardResult{doc: matchingDoc, similarity: maxSimilarity, err: err}
 		}
 
 		//fmt.Println("doc.Metadata:", doc.Metadata)
@@ -378,11 +561,10 @@ func (db *VectorDB) Query(collectionName string, queryText string, metadataFilte
 	}
 
 	if err := iter.Error(); err != nil {
-		return matchingDoc, err
+		return shardResult{doc: matchingDoc, similarity: maxSimilarity, err: err}
 	}
 
-	// Return the ID of the nearest document.
-	return matchingDoc, nil
+	return shardResult{doc: matchingDoc, similarity: maxSimilarity}
 }
 
 
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+)
+
+/*
+ * openTestDB opens a VectorDB in a temporary directory that is removed after the test
+ */
+func openTestDB(tb testing.TB, opts *pebble.Options) *VectorDB {
+	tb.Helper()
+
+	db, err := pebble.Open(tb.TempDir(), opts)
+	if err != nil {
+		tb.Fatalf("error opening Pebble DB: %v", err)
+	}
+	tb.Cleanup(func() { db.Close() })
+
+	return &VectorDB{db: db}
+}
+
+/*
+ * loadDocuments writes n documents with synthetic embeddings to a collection in the given
+ * number of batches, bypassing the embeddings API. Embeddings are drawn from a small pool
+ * of vectors so that many documents tie on similarity. If shuffled is set, documents are
+ * written in random order, so every batch spans the whole collection. If flush is set,
+ * the DB is flushed after every batch so the collection is spread over several SSTables
+ */
+func loadDocuments(tb testing.TB, db *VectorDB, collectionName string, n, batches int, shuffled, flush bool, pool [][]float64, rng *rand.Rand) {
+	tb.Helper()
+
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	if shuffled {
+		rng.Shuffle(n, func(i, j int) { order[i], order[j] = order[j], order[i] })
+	}
+
+	sources := []string{"Notion", "Slack", "Drive"}
+	perBatch := (n + batches - 1) / batches
+	for start := 0; start < n; start += perBatch {
+		end := start + perBatch
+		if end > n {
+			end = n
+		}
+		batch := db.db.NewBatch()
+		for _, i := range order[start:end] {
+			doc := Document{
+				ID:        fmt.Sprintf("doc%07d", i),
+				Text:      fmt.Sprintf("document %d", i),
+				Embedding: pool[rng.Intn(len(pool))],
+				Metadata:  map[string]interface{}{"source": sources[rng.Intn(len(sources))]},
+			}
+			docBytes, err := json.Marshal(doc)
+			if err != nil {
+				tb.Fatalf("error serializing document: %v", err)
+			}
+			if err := batch.Set([]byte(collectionName+":"+doc.ID), docBytes, nil); err != nil {
+				tb.Fatalf("error writing document: %v", err)
+			}
+		}
+		if err := batch.Commit(pebble.NoSync); err != nil {
+			tb.Fatalf("error committing batch: %v", err)
+		}
+		if flush {
+			if err := db.db.Flush(); err != nil {
+				tb.Fatalf("error flushing Pebble DB: %v", err)
+			}
+		}
+	}
+}
+
+/*
+ * shardSizes counts the documents in each sub-range between consecutive bounds
+ */
+func shardSizes(tb testing.TB, db *VectorDB, bounds [][]byte) []int {
+	tb.Helper()
+
+	sizes := make([]int, len(bounds)-1)
+	for i := range sizes {
+		iter := db.db.NewIter(&pebble.IterOptions{
+			LowerBound: bounds[i],
+			UpperBound: bounds[i+1],
+		})
+		for iter.First(); iter.Valid(); iter.Next() {
+			sizes[i]++
+		}
+		if err := iter.Close(); err != nil {
+			tb.Fatalf("error iterating sub-range: %v", err)
+		}
+	}
+	return sizes
+}
+
+/*
+ * randomVectors returns n random vectors with the given number of dimensions
+ */
+func randomVectors(n, dims int, rng *rand.Rand) [][]float64 {
+	vectors := make([][]float64, n)
+	for i := range vectors {
+		vectors[i] = make([]float64, dims)
+		for j := range vectors[i] {
+			vectors[i][j] = rng.Float64()*2 - 1
+		}
+	}
+	return vectors
+}
+
+func TestQueryShardsMatchSingleThreaded(t *testing.T) {
+	const numDocs = 4000
+
+	lowerBound := []byte("TestCollection:")
+	upperBound := []byte("TestCollection:\xff")
+
+	// Each fixture lays the collection out differently on disk. Automatic compactions are
+	// disabled so the layout stays as written.
+	fixtures := map[string]func(db *VectorDB, pool [][]float64, rng *rand.Rand){
+		"sequential": func(db *VectorDB, pool [][]float64, rng *rand.Rand) {
+			loadDocuments(t, db, "TestCollection", numDocs, 8, false, true, pool, rng)
+		},
+		"random order": func(db *VectorDB, pool [][]float64, rng *rand.Rand) {
+			loadDocuments(t, db, "TestCollection", numDocs, 8, true, true, pool, rng)
+		},
+		"compacted": func(db *VectorDB, pool [][]float64, rng *rand.Rand) {
+			loadDocuments(t, db, "TestCollection", numDocs, 8, true, true, pool, rng)
+			if err := db.db.Compact(lowerBound, upperBound, true); err != nil {
+				t.Fatalf("error compacting Pebble DB: %v", err)
+			}
+		},
+		"memtable": func(db *VectorDB, pool [][]float64, rng *rand.Rand) {
+			loadDocuments(t, db, "TestCollection", numDocs, 8, true, false, pool, rng)
+		},
+	}
+
+	for fixtureName, load := range fixtures {
+		t.Run(fixtureName, func(t *testing.T) {
+			db := openTestDB(t, &pebble.Options{DisableAutomaticCompactions: true})
+			rng := rand.New(rand.NewSource(1))
+			pool := randomVectors(16, 8, rng)
+			load(db, pool, rng)
+			loadDocuments(t, db, "OtherCollection", 500, 1, true, false, pool, rng)
+
+			// The collection must be split into the requested number of sub-ranges of similar size.
+			const shards = 4
+			snap := db.db.NewSnapshot()
+			bounds, err := db.splitKeyRange(snap, lowerBound, upperBound, shards)
+			snap.Close()
+			if err != nil {
+				t.Fatalf("error splitting key range: %v", err)
+			}
+			sizes := shardSizes(t, db, bounds)
+			if len(sizes) != shards {
+				t.Fatalf("expected %d sub-ranges, got %d with bounds %q", shards, len(sizes), bounds)
+			}
+			for i, size := range sizes {
+				if size < numDocs/shards/2 || size > numDocs/shards*3/2 {
+					t.Errorf("sub-range %d holds %d documents, expected about %d: %v", i, size, numDocs/shards, sizes)
+				}
+			}
+
+			queries := map[string][]float64{
+				"tied":   pool[3],
+				"random": randomVectors(1, 8, rng)[0],
+			}
+			filters := map[string]func() map[string]interface{}{
+				"none":       func() map[string]interface{} { return nil },
+				"source":     func() map[string]interface{} { return map[string]interface{}{"source": "Slack"} },
+				"uppercase":  func() map[string]interface{} { return map[string]interface{}{"Source": "Drive"} },
+				"no matches": func() map[string]interface{} { return map[string]interface{}{"source": "Missing"} },
+			}
+
+			for queryName, queryVec := range queries {
+				for filterName, filter := range filters {
+					db.SetQueryShards(1)
+					want, err := db.queryByVector("TestCollection", queryVec, filter())
+					if err != nil {
+						t.Fatalf("%s/%s: error querying with 1 shard: %v", queryName, filterName, err)
+					}
+					if filterName != "no matches" && want.ID == "" {
+						t.Fatalf("%s/%s: expected a matching document", queryName, filterName)
+					}
+
+					for _, shards := range []int{2, 4, 7, runtime.NumCPU(), 0} {
+						db.SetQueryShards(shards)
+						got, err := db.queryByVector("TestCollection", queryVec, filter())
+						if err != nil {
+							t.Fatalf("%s/%s: error querying with %d shards: %v", queryName, filterName, shards, err)
+						}
+						if got.ID != want.ID {
+							t.Errorf("%s/%s: %d shards returned %q, 1 shard returned %q", queryName, filterName, shards, got.ID, want.ID)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkQuery(b *testing.B) {
+	const (
+		numDocs = 300000
+		dims    = 16
+	)
+
+	lowerBound := []byte("BenchCollection:")
+	upperBound := []byte("BenchCollection:\xff")
+
+	db := openTestDB(b, &pebble.Options{})
+	rng := rand.New(rand.NewSource(1))
+	pool := randomVectors(1024, dims, rng)
+	loadDocuments(b, db, "BenchCollection", numDocs, 30, true, true, pool, rng)
+	queryVec := randomVectors(1, dims, rng)[0]
+
+	// Settle the collection into its final layout, so background compactions don't skew the timings.
+	if err := db.db.Compact(lowerBound, upperBound, true); err != nil {
+		b.Fatalf("error compacting Pebble DB: %v", err)
+	}
+
+	var baseline float64 // ns/op of the single-threaded scan
+	for _, shards := range []int{1, 2, 4, runtime.NumCPU()} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			// Report how many sub-ranges are actually scanned, which may be fewer than asked for.
+			snap := db.db.NewSnapshot()
+			bounds, err := db.splitKeyRange(snap, lowerBound, upperBound, shards)
+			snap.Close()
+			if err != nil {
+				b.Fatalf("error splitting key range: %v", err)
+			}
+
+			db.SetQueryShards(shards)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.queryByVector("BenchCollection", queryVec, nil); err != nil {
+					b.Fatalf("error querying: %v", err)
+				}
+			}
+			b.StopTimer()
+
+			nsPerOp := float64(b.Elapsed().Nanoseconds()) / float64(b.N)
+			if shards == 1 {
+				baseline = nsPerOp
+			}
+			b.ReportMetric(float64(len(bounds)-1), "subranges")
+			b.ReportMetric(float64(numDocs)*1e9/nsPerOp, "docs/s")
+			if baseline > 0 {
+				b.ReportMetric(baseline/nsPerOp, "speedup")
+			}
+		})
+	}
+
+	// The boundaries are picked before every scan, so their cost must stay small next to it.
+	b.Run(fmt.Sprintf("splitKeyRange/shards=%d", runtime.NumCPU()), func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			snap := db.db.NewSnapshot()
+			_, err := db.splitKeyRange(snap, lowerBound, upperBound, runtime.NumCPU())
+			snap.Close()
+			if err != nil {
+				b.Fatalf("error splitting key range: %v", err)
+			}
+		}
+	})
+}